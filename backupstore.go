@@ -0,0 +1,141 @@
+package wal
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// BackupStore is the destination Backup writes to and RecoverFromBackup
+// reads from, modeled on the small storage.Storage interface goleveldb
+// uses for its own backend abstraction. A log's backups don't have to
+// live next to its own file on the local filesystem; SetBackupStore
+// points them anywhere durable instead
+type BackupStore interface {
+	// Put stores size bytes read from r under name, replacing any
+	// object already stored under that name
+	Put(name string, r io.Reader, size int64) error
+	// Get returns a reader over the object stored under name and its
+	// size. The caller must Close the returned ReadCloser
+	Get(name string) (io.ReadCloser, int64, error)
+	// List returns the name of every object currently in the store
+	List() ([]string, error)
+	// Delete removes the object stored under name
+	Delete(name string) error
+}
+
+// LocalBackupStore is a BackupStore backed by a directory on the local
+// filesystem. It's the default store for a log opened with Open, and
+// reproduces Backup/RecoverFromBackup's behavior from before BackupStore
+// existed
+type LocalBackupStore struct {
+	dir string
+}
+
+// NewLocalBackupStore returns a LocalBackupStore that stores objects as
+// files in dir, creating dir if it doesn't already exist
+func NewLocalBackupStore(dir string) (*LocalBackupStore, error) {
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return nil, err
+	}
+	return &LocalBackupStore{dir: dir}, nil
+}
+
+func (s *LocalBackupStore) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+func (s *LocalBackupStore) Put(name string, r io.Reader, size int64) error {
+	f, err := os.OpenFile(s.path(name), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0664)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return errors.New("wal: short write to backup store")
+	}
+	return nil
+}
+
+func (s *LocalBackupStore) Get(name string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+func (s *LocalBackupStore) List() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *LocalBackupStore) Delete(name string) error {
+	return os.Remove(s.path(name))
+}
+
+// S3BackupStore is a BackupStore backed by an S3 bucket. It's a stub:
+// the field shape is what a real implementation needs, but Put/Get/
+// List/Delete aren't wired to an S3 client yet
+type S3BackupStore struct {
+	Bucket string
+	Prefix string
+}
+
+func (s *S3BackupStore) Put(name string, r io.Reader, size int64) error {
+	return errors.New("wal: S3BackupStore is a stub and isn't wired to an S3 client yet")
+}
+
+func (s *S3BackupStore) Get(name string) (io.ReadCloser, int64, error) {
+	return nil, 0, errors.New("wal: S3BackupStore is a stub and isn't wired to an S3 client yet")
+}
+
+func (s *S3BackupStore) List() ([]string, error) {
+	return nil, errors.New("wal: S3BackupStore is a stub and isn't wired to an S3 client yet")
+}
+
+func (s *S3BackupStore) Delete(name string) error {
+	return errors.New("wal: S3BackupStore is a stub and isn't wired to an S3 client yet")
+}
+
+// GCSBackupStore is a BackupStore backed by a GCS bucket; see
+// S3BackupStore, it's the same kind of stub for GCS
+type GCSBackupStore struct {
+	Bucket string
+	Prefix string
+}
+
+func (s *GCSBackupStore) Put(name string, r io.Reader, size int64) error {
+	return errors.New("wal: GCSBackupStore is a stub and isn't wired to a GCS client yet")
+}
+
+func (s *GCSBackupStore) Get(name string) (io.ReadCloser, int64, error) {
+	return nil, 0, errors.New("wal: GCSBackupStore is a stub and isn't wired to a GCS client yet")
+}
+
+func (s *GCSBackupStore) List() ([]string, error) {
+	return nil, errors.New("wal: GCSBackupStore is a stub and isn't wired to a GCS client yet")
+}
+
+func (s *GCSBackupStore) Delete(name string) error {
+	return errors.New("wal: GCSBackupStore is a stub and isn't wired to a GCS client yet")
+}
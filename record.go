@@ -0,0 +1,329 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	// BlockSize is the size of a physical block on disk. A logical
+	// record's bytes always live inside some whole number of blocks; a
+	// record that doesn't fit in what's left of the current block is
+	// split into FIRST/MIDDLE/LAST fragments across the boundary, so a
+	// torn write or a corrupt block only loses the records in that one
+	// block instead of everything written after it
+	BlockSize = 32 * 1024
+)
+
+// physical fragment types, written in the type byte of every fragment header
+const (
+	recFull   uint8 = 1
+	recFirst  uint8 = 2
+	recMiddle uint8 = 3
+	recLast   uint8 = 4
+)
+
+// recordHeader is the physical header in front of every fragment: a
+// checksum over the fragment's payload, its length, and its type. Its
+// encoded width depends on the owning log's Checksum
+type recordHeader struct {
+	sum    uint64
+	length uint16
+	typ    uint8
+}
+
+func (h recordHeader) encode(sumSize int) []byte {
+	b := make([]byte, sumSize+3)
+	putSum(b, h.sum, sumSize)
+	binary.LittleEndian.PutUint16(b[sumSize:], h.length)
+	b[sumSize+2] = h.typ
+	return b
+}
+
+func decodeRecordHeader(b []byte, sumSize int) recordHeader {
+	return recordHeader{
+		sum:    getSum(b, sumSize),
+		length: binary.LittleEndian.Uint16(b[sumSize:]),
+		typ:    b[sumSize+2],
+	}
+}
+
+func putSum(b []byte, sum uint64, sumSize int) {
+	switch sumSize {
+	case 4:
+		binary.LittleEndian.PutUint32(b, uint32(sum))
+	case 8:
+		binary.LittleEndian.PutUint64(b, sum)
+	default:
+		panic(fmt.Sprintf("wal: unsupported checksum size %v", sumSize))
+	}
+}
+
+func getSum(b []byte, sumSize int) uint64 {
+	switch sumSize {
+	case 4:
+		return uint64(binary.LittleEndian.Uint32(b))
+	case 8:
+		return binary.LittleEndian.Uint64(b)
+	default:
+		panic(fmt.Sprintf("wal: unsupported checksum size %v", sumSize))
+	}
+}
+
+// writeChunked physically writes p to file starting at byte offset pos,
+// fragmenting it across BlockSize boundaries as needed, and returns the
+// number of physical bytes written including any zero-padded block tail.
+// A zero-length p (the sync record) is written as a single FULL fragment
+func (w *Wal) writeChunked(file *os.File, pos int64, p []byte) (int64, error) {
+	return w.writeChunkedFrom(file, pos, bytes.NewReader(p), int64(len(p)))
+}
+
+// writeChunkedFrom is writeChunked, but reads the record's payload from
+// r instead of requiring it already be in memory, so a large record can
+// be streamed straight from its source one fragment at a time
+func (w *Wal) writeChunkedFrom(file *os.File, pos int64, r io.Reader, size int64) (int64, error) {
+	hdrSize := w.headerSize()
+	start := pos
+	first := true
+	remaining := size
+	for {
+		left := BlockSize - int(pos%BlockSize)
+		if left < hdrSize {
+			if _, err := file.WriteAt(make([]byte, left), pos); err != nil {
+				return 0, err
+			}
+			pos += int64(left)
+			left = BlockSize
+		}
+		avail := int64(left - hdrSize)
+		n := remaining
+		last := n <= avail
+		if !last {
+			n = avail
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return 0, err
+		}
+		var typ uint8
+		switch {
+		case first && last:
+			typ = recFull
+		case first:
+			typ = recFirst
+		case last:
+			typ = recLast
+		default:
+			typ = recMiddle
+		}
+		h := recordHeader{sum: w.checksum.Sum(buf), length: uint16(n), typ: typ}
+		if _, err := file.WriteAt(h.encode(w.checksum.Size()), pos); err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			if _, err := file.WriteAt(buf, pos+int64(hdrSize)); err != nil {
+				return 0, err
+			}
+		}
+		pos += int64(hdrSize) + n
+		remaining -= n
+		first = false
+		if last {
+			break
+		}
+	}
+	return pos - start, nil
+}
+
+// fragment describes one physical fragment of a logical record: where
+// its body lives in the store file, how long it is, and its checksum
+type fragment struct {
+	bodyPos int64
+	length  uint16
+	sum     uint64
+}
+
+// readRecord reads the next logical record, reassembling it across
+// FIRST/MIDDLE/LAST fragments into r.data. An unexpected fragment type
+// or a corrupt header can't be trusted to know where the next record
+// starts, so scanFragmentsOnce resyncs to the next block boundary for
+// those; a bad body, though, is discovered only after scanFragments has
+// already walked every fragment's header for this record and advanced
+// r.pos past it, so the position of the next record is still known and
+// only this one record is lost, not the rest of the block. Either way
+// the error that caused a record to be skipped is kept and can be
+// retrieved with Reader.LastError
+func (r *Reader) readRecord() error {
+	dataPos, frags, err := r.scanFragments()
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 0, len(frags))
+	for _, f := range frags {
+		body := make([]byte, f.length)
+		if n, rerr := r.file().ReadAt(body, f.bodyPos); rerr != nil || n != len(body) {
+			r.lastErr = fmt.Errorf("wal: fail to read record body: %w", rerr)
+			return r.readRecord()
+		}
+		if r.w.checksum.Sum(body) != f.sum {
+			r.lastErr = errors.New("wal: checksum mismatch, data is broken")
+			return r.readRecord()
+		}
+		data = append(data, body...)
+	}
+	r.data = data
+	r.dataPos = dataPos
+	return nil
+}
+
+// minDataPos is the lowest legal r.pos for this reader. A segmented
+// log's per-segment store file has no header of its own, so it's 0;
+// a legacy log's single file reserves its first MetaHeaderSize bytes
+// for the meta header, so a reader positioned at or before 0 (e.g. from
+// NewReader(0)) must skip past it rather than mistake it for a
+// corrupt record
+func (r *Reader) minDataPos() int64 {
+	if r.seg != nil {
+		return 0
+	}
+	return MetaHeaderSize
+}
+
+// scanFragments locates the fragments making up the next logical
+// record without reading their bodies, so callers can choose to read
+// them eagerly (readRecord) or lazily (NextReader)
+func (r *Reader) scanFragments() (dataPos int64, frags []fragment, err error) {
+	for {
+		dataPos, frags, retry, err := r.scanFragmentsOnce()
+		if err != nil {
+			return 0, nil, err
+		}
+		if !retry {
+			return dataPos, frags, nil
+		}
+	}
+}
+
+// scanFragmentsOnce walks fragment headers starting at r.pos until it
+// finds a complete logical record. retry is true, with a nil error, when
+// a corrupt fragment was skipped via resync and the caller should try
+// again from the next block
+func (r *Reader) scanFragmentsOnce() (dataPos int64, frags []fragment, retry bool, err error) {
+	hdrSize := r.w.headerSize()
+	if min := r.minDataPos(); r.pos < min {
+		r.pos = min
+	}
+	inFragment := false
+	for {
+		if r.pos+int64(hdrSize) > r.size {
+			return 0, nil, false, io.EOF
+		}
+		if left := BlockSize - int(r.pos%BlockSize); left < hdrSize {
+			r.pos += int64(left)
+			continue
+		}
+		if !inFragment {
+			dataPos = r.pos
+		}
+		hb := make([]byte, hdrSize)
+		if n, rerr := r.file().ReadAt(hb, r.pos); rerr != nil || n != hdrSize {
+			r.resync(fmt.Errorf("wal: fail to read record header: %w", rerr))
+			return 0, nil, true, nil
+		}
+		h := decodeRecordHeader(hb, r.w.checksum.Size())
+		bodyPos := r.pos + int64(hdrSize)
+		if int64(h.length) > r.size-bodyPos {
+			r.resync(errors.New("wal: corrupt record length"))
+			return 0, nil, true, nil
+		}
+		wantsStart := h.typ == recFull || h.typ == recFirst
+		if wantsStart == inFragment {
+			r.resync(fmt.Errorf("wal: unexpected fragment type %v", h.typ))
+			return 0, nil, true, nil
+		}
+		frags = append(frags, fragment{bodyPos: bodyPos, length: h.length, sum: h.sum})
+		r.pos = bodyPos + int64(h.length)
+		inFragment = true
+		if h.typ == recFull || h.typ == recLast {
+			return dataPos, frags, false, nil
+		}
+	}
+}
+
+// NextReader returns the position and a bounded io.Reader over the
+// payload of the next logical record, assembled lazily across block
+// fragments instead of buffering the whole record up front the way Next
+// does. The returned reader is invalidated by the following call to
+// NextReader or Next
+func (r *Reader) NextReader() (int64, io.Reader, error) {
+	for {
+		dataPos, frags, err := r.scanFragments()
+		if err != nil {
+			if err == io.EOF {
+				if r.seg != nil && r.advanceSegment() {
+					continue
+				}
+				return -1, nil, nil
+			}
+			return -1, nil, err
+		}
+		pos := dataPos
+		if r.seg != nil {
+			pos += r.segBaseByteOffset
+		}
+		r.stream = fragmentReader{file: r.file(), checksum: r.w.checksum, frags: frags}
+		return pos, &r.stream, nil
+	}
+}
+
+// fragmentReader is the io.Reader returned by Reader.NextReader. It
+// serves one fragment's body at a time, verifying its checksum as each
+// is pulled in, so it never buffers more than a single fragment
+type fragmentReader struct {
+	file     *os.File
+	checksum Checksum
+	frags    []fragment
+	cur      []byte
+}
+
+func (fr *fragmentReader) Read(p []byte) (int, error) {
+	for len(fr.cur) == 0 {
+		if len(fr.frags) == 0 {
+			return 0, io.EOF
+		}
+		f := fr.frags[0]
+		fr.frags = fr.frags[1:]
+		body := make([]byte, f.length)
+		if n, err := fr.file.ReadAt(body, f.bodyPos); err != nil || n != len(body) {
+			return 0, fmt.Errorf("wal: fail to read record body: %w", err)
+		}
+		if fr.checksum.Sum(body) != f.sum {
+			return 0, errors.New("wal: checksum mismatch, data is broken")
+		}
+		fr.cur = body
+	}
+	n := copy(p, fr.cur)
+	fr.cur = fr.cur[n:]
+	return n, nil
+}
+
+// resync records err as the reader's LastError and advances past the
+// rest of the current block, so the next read starts clean at the
+// following block boundary
+func (r *Reader) resync(err error) {
+	r.lastErr = err
+	r.pos += int64(BlockSize - int(r.pos%BlockSize))
+	if r.pos > r.size {
+		r.pos = r.size
+	}
+}
+
+// LastError returns the most recent corruption the reader resynced
+// past, or nil if every record read so far has been clean
+func (r *Reader) LastError() error {
+	return r.lastErr
+}
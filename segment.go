@@ -0,0 +1,341 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tysonmote/gommap"
+)
+
+// indexEntrySize is the size of a single fixed-width index entry:
+// (relative record offset uint32, byte offset into the store file uint32)
+const indexEntrySize = 8
+
+// segment is one append-only store file plus its mmap'd index. Records
+// are addressed within a segment by their offset relative to baseRecordID;
+// the index maps that relative offset to the byte offset of the record
+// in the store file, so NewReaderFromRecordID can seek directly to it
+// instead of scanning
+type segment struct {
+	baseRecordID uint64
+	// baseByteOffset is this segment's first byte's position in the
+	// logical, log-wide byte stream. Computed at load time from the
+	// size of every older segment, never persisted
+	baseByteOffset int64
+	storePath      string
+	indexPath      string
+
+	store     *os.File
+	storeSize int64
+
+	indexFile *os.File
+	indexMap  gommap.MMap
+	// indexLen is the number of index entries written so far
+	indexLen int64
+
+	// next is the segment that follows this one, or nil if this is the
+	// newest segment seen so far. It's set once, when the following
+	// segment is created or loaded, and never changed again, including
+	// by TruncateBefore: a Reader that's fallen behind a dropped prefix
+	// still has its own handle open on this segment and needs to be
+	// able to walk forward to the next one, which a slice index into
+	// the ever-reslicing, ever-renumbered w.segments can't give it
+	next *segment
+}
+
+// indexCapacity is the number of entries pre-allocated for a segment's
+// index file. A record's physical header is never smaller than
+// headerSize bytes (its body can be zero-length, as a sync record's
+// is), so a segment can never hold more records than its size divided
+// by that, plus the interleaved sync records
+func indexCapacity(segmentSize int64, headerSize int) int64 {
+	return segmentSize/int64(headerSize) + 1
+}
+
+func segmentPaths(dir string, baseRecordID uint64) (store, index string) {
+	name := fmt.Sprintf("%020d", baseRecordID)
+	return filepath.Join(dir, name+".store"), filepath.Join(dir, name+".index")
+}
+
+// metaPath is the file a segmented log records its checksum algorithm
+// in, since the usual place (offset 0 of the log) isn't available: the
+// first segment is itself subject to being dropped by TruncateBefore
+func metaPath(dir string) string {
+	return filepath.Join(dir, "meta")
+}
+
+// createSegment creates a brand new, empty segment starting at baseRecordID
+func createSegment(dir string, baseRecordID uint64, opts Options) (*segment, error) {
+	storePath, indexPath := segmentPaths(dir, baseRecordID)
+	store, err := os.OpenFile(storePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0664)
+	if err != nil {
+		return nil, err
+	}
+	s := &segment{baseRecordID: baseRecordID, storePath: storePath, indexPath: indexPath, store: store}
+	if err := s.openIndex(indexCapacity(opts.SegmentSize, recordHeaderSize(opts.Checksum))); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// openSegment opens a segment that was previously created, remapping its
+// index and recomputing indexLen/storeSize from what's on disk
+func openSegment(dir string, baseRecordID uint64) (*segment, error) {
+	storePath, indexPath := segmentPaths(dir, baseRecordID)
+	store, err := os.OpenFile(storePath, os.O_RDWR, 0664)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := store.Stat()
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	s := &segment{baseRecordID: baseRecordID, storePath: storePath, indexPath: indexPath, store: store, storeSize: fi.Size()}
+	indexFile, err := os.OpenFile(indexPath, os.O_RDWR, 0664)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	ifi, err := indexFile.Stat()
+	if err != nil {
+		store.Close()
+		indexFile.Close()
+		return nil, err
+	}
+	if err := s.mapIndex(indexFile, ifi.Size()/indexEntrySize); err != nil {
+		store.Close()
+		return nil, err
+	}
+	// the index is pre-allocated to its full capacity; indexLen is the
+	// count of entries actually written, found by scanning for the
+	// first all-zero entry (a relative offset of 0 only ever appears
+	// at index 0, since the first record of a segment is never written
+	// twice). An empty store file holds no records, so no entries
+	n := ifi.Size() / indexEntrySize
+	for i := int64(1); i < n; i++ {
+		if binary.LittleEndian.Uint32(s.indexMap[i*indexEntrySize:]) == 0 &&
+			binary.LittleEndian.Uint32(s.indexMap[i*indexEntrySize+4:]) == 0 {
+			n = i
+			break
+		}
+	}
+	if s.storeSize == 0 {
+		n = 0
+	}
+	s.indexLen = n
+	return s, nil
+}
+
+func (s *segment) openIndex(capacity int64) error {
+	indexFile, err := os.OpenFile(s.indexPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0664)
+	if err != nil {
+		return err
+	}
+	return s.mapIndex(indexFile, capacity)
+}
+
+func (s *segment) mapIndex(indexFile *os.File, capacity int64) error {
+	if err := indexFile.Truncate(capacity * indexEntrySize); err != nil {
+		indexFile.Close()
+		return err
+	}
+	mm, err := gommap.Map(indexFile.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED)
+	if err != nil {
+		indexFile.Close()
+		return err
+	}
+	s.indexFile = indexFile
+	s.indexMap = mm
+	return nil
+}
+
+// appendIndex records where the record with the given relative offset
+// starts in the store file
+func (s *segment) appendIndex(relativeRecordOffset, storeOffset uint32) {
+	off := s.indexLen * indexEntrySize
+	binary.LittleEndian.PutUint32(s.indexMap[off:], relativeRecordOffset)
+	binary.LittleEndian.PutUint32(s.indexMap[off+4:], storeOffset)
+	s.indexLen++
+}
+
+// lookup returns the byte offset, in the store file, of the record whose
+// relative offset is relativeRecordOffset. The index slot numbered
+// relativeRecordOffset is checked first, an O(1) read of the mmap'd
+// index; if that slot holds a different record, lookup falls back to a
+// binary search over the index
+func (s *segment) lookup(relativeRecordOffset uint32) (storeOffset uint32, ok bool) {
+	if i := int64(relativeRecordOffset); i < s.indexLen {
+		off := i * indexEntrySize
+		if binary.LittleEndian.Uint32(s.indexMap[off:]) == relativeRecordOffset {
+			return binary.LittleEndian.Uint32(s.indexMap[off+4:]), true
+		}
+	}
+	lo, hi := int64(0), s.indexLen-1
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		off := mid * indexEntrySize
+		rel := binary.LittleEndian.Uint32(s.indexMap[off:])
+		switch {
+		case rel == relativeRecordOffset:
+			return binary.LittleEndian.Uint32(s.indexMap[off+4:]), true
+		case rel < relativeRecordOffset:
+			lo = mid + 1
+		default:
+			hi = mid - 1
+		}
+	}
+	return 0, false
+}
+
+func (s *segment) close() error {
+	err := s.indexMap.UnsafeUnmap()
+	if e := s.indexFile.Close(); err == nil {
+		err = e
+	}
+	if e := s.store.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// truncateAfter shrinks the segment's store file down to localPos bytes
+// and drops every index entry pointing past it
+func (s *segment) truncateAfter(localPos int64) error {
+	if err := s.store.Truncate(localPos); err != nil {
+		return err
+	}
+	s.storeSize = localPos
+	n := int64(0)
+	for ; n < s.indexLen; n++ {
+		off := binary.LittleEndian.Uint32(s.indexMap[n*indexEntrySize+4:])
+		if int64(off) >= localPos {
+			break
+		}
+	}
+	s.indexLen = n
+	return nil
+}
+
+// truncateBefore rewrites the segment so it only contains the bytes
+// from localPos onward, renumbering its index from 0 and giving the
+// segment a new baseRecordID. This is the copy path used only for the
+// single segment that straddles a TruncateBefore boundary; every fully
+// sealed segment before it is just removed.
+// s.storePath's old content is renamed aside under pendingName(s.storePath)
+// rather than overwritten outright, so a reader already iterating this
+// segment through its own independently opened handle keeps reading it
+// fine; onPendingDelete is called with that name to clean it up once
+// nothing still has it open (see Wal.deletePending).
+// The segment's store and index files are renamed to match its new
+// baseRecordID: segmentPaths derives a segment's name from baseRecordID,
+// so openSegment would otherwise recompute the stale, pre-truncation
+// baseRecordID from the filename after a restart
+func (s *segment) truncateBefore(localPos int64, pendingName func(string) string, onPendingDelete func(string)) error {
+	tmpStorePath := s.storePath + ".tmp"
+	tmpStore, err := os.OpenFile(tmpStorePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0664)
+	if err != nil {
+		return err
+	}
+	if _, err := s.store.Seek(localPos, 0); err != nil {
+		tmpStore.Close()
+		return err
+	}
+	if _, err := io.Copy(tmpStore, s.store); err != nil {
+		tmpStore.Close()
+		return err
+	}
+	tmpStore.Close()
+	if err := s.store.Close(); err != nil {
+		return err
+	}
+
+	// renumber the index before picking the segment's new on-disk
+	// names, so newBaseRecordID is known up front
+	oldLen := s.indexLen
+	w := int64(0)
+	for r := int64(0); r < oldLen; r++ {
+		off := binary.LittleEndian.Uint32(s.indexMap[r*indexEntrySize+4:])
+		if int64(off) < localPos {
+			continue
+		}
+		binary.LittleEndian.PutUint32(s.indexMap[w*indexEntrySize:], uint32(w))
+		binary.LittleEndian.PutUint32(s.indexMap[w*indexEntrySize+4:], off-uint32(localPos))
+		w++
+	}
+	newBaseRecordID := s.baseRecordID + uint64(oldLen-w)
+	newStorePath, newIndexPath := segmentPaths(filepath.Dir(s.storePath), newBaseRecordID)
+
+	pending := pendingName(s.storePath)
+	if err := os.Rename(s.storePath, pending); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpStorePath, newStorePath); err != nil {
+		return err
+	}
+	onPendingDelete(pending)
+	if newIndexPath != s.indexPath {
+		if err := os.Rename(s.indexPath, newIndexPath); err != nil {
+			return err
+		}
+	}
+	store, err := os.OpenFile(newStorePath, os.O_RDWR, 0664)
+	if err != nil {
+		return err
+	}
+	s.store = store
+	s.storeSize -= localPos
+	s.storePath = newStorePath
+	s.indexPath = newIndexPath
+	s.baseRecordID = newBaseRecordID
+	s.indexLen = w
+	return nil
+}
+
+// remove deletes both files backing the segment; used by TruncateBefore
+// and TruncateAfter to cheaply drop whole sealed segments. The store
+// file is renamed aside under pendingName(s.storePath) first rather
+// than removed outright, since a reader already iterating this segment
+// holds its own independently opened handle onto it (see
+// onPendingDelete/Wal.deletePending); the index file is removed
+// directly, since nothing keeps a handle on it past a single lookup
+func (s *segment) remove(pendingName func(string) string, onPendingDelete func(string)) error {
+	if err := s.close(); err != nil {
+		return err
+	}
+	pending := pendingName(s.storePath)
+	if err := os.Rename(s.storePath, pending); err != nil {
+		return err
+	}
+	onPendingDelete(pending)
+	return os.Remove(s.indexPath)
+}
+
+// listSegmentBaseIDs returns the baseRecordID of every segment found in
+// dir, sorted ascending
+func listSegmentBaseIDs(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".store") {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), ".store"), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
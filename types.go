@@ -1,6 +1,7 @@
 package wal
 
 import (
+	"io"
 	"os"
 	"sync"
 	"sync/atomic"
@@ -11,22 +12,92 @@ const (
 	MaxRecordSize = 1<<32 - 1
 	// SyncConcurrency is the number of concurrent syncs
 	SyncConcurrency = 1 << 10
-	// RecordHeaderSize is the size of the record header
-	RecordHeaderSize = 8
+	// MaxRecordHeaderSize is the size of the widest physical record
+	// header this package can produce: checksum (8 bytes, XXHash64) +
+	// length (2 bytes) + type (1 byte). A log's actual header size
+	// depends on its configured Checksum and is usually narrower; the
+	// package itself sizes headers from the log's Checksum (see
+	// recordHeaderSize) and doesn't use this constant
+	MaxRecordHeaderSize = 8 + 2 + 1
+	// DefaultSegmentSize is the size at which a segmented write ahead
+	// log rolls its active segment, used when Options.SegmentSize is 0
+	DefaultSegmentSize = 256 << 20
 )
 
+// Options configures the segmented layout of a write ahead log opened
+// with OpenSegmented. The zero value is valid and uses DefaultSegmentSize
+// and CRC32IEEE
+type Options struct {
+	// SegmentSize is the size, in bytes, at which the active segment is
+	// rolled into a new one. Defaults to DefaultSegmentSize
+	SegmentSize int64
+	// Checksum is the algorithm used to verify every record fragment.
+	// Defaults to CRC32IEEE. Once a log has been created its checksum
+	// can't change; OpenSegmented verifies this against the log's meta
+	// file and fails rather than silently mixing algorithms
+	Checksum Checksum
+}
+
+func (o Options) withDefaults() Options {
+	if o.SegmentSize <= 0 {
+		o.SegmentSize = DefaultSegmentSize
+	}
+	if o.Checksum == nil {
+		o.Checksum = CRC32IEEE{}
+	}
+	return o
+}
+
+// OpenOption configures a single-file write ahead log opened with Open
+type OpenOption func(*openConfig)
+
+// WithChecksum selects the algorithm used to verify every record
+// fragment of a log opened with Open. Only takes effect the first time
+// a log is created; an existing log's checksum is fixed and read back
+// from its meta header, and reopening it with a different one is an
+// error rather than something that silently corrupts reads
+func WithChecksum(c Checksum) OpenOption {
+	return func(cfg *openConfig) { cfg.checksum = c }
+}
+
+type openConfig struct {
+	checksum Checksum
+}
+
 // Reader represents a reader for the write ahead log,
 // Reader is thread-unsafe
 type Reader struct {
 	w *Wal
-	// read position for the next record
+	// seg is the segment currently being read, nil in legacy mode
+	seg *segment
+	// segBaseByteOffset is a snapshot of seg.baseByteOffset taken when
+	// seg was last set (at NewReader/NewReaderFromRecordID, or by
+	// advanceSegment), rather than read live off seg itself: seg's
+	// baseByteOffset is mutated in place by TruncateBefore with no
+	// synchronization a Reader participates in, so caching it here
+	// keeps every position this Reader reports internally consistent
+	// and race-free instead of jumping or racing underneath it
+	segBaseByteOffset int64
+	// read position for the next record, relative to seg in segmented
+	// mode, relative to w.fp in legacy mode
 	pos int64
-	// size of the write ahead log
+	// size of the write ahead log, in the same units as pos
 	size int64
-	// data is the buffer for read write ahead log
+	// ownFile is this reader's own handle onto whichever file it's
+	// currently positioned in, opened independently of w.fp/seg.store so
+	// that a concurrent TruncateBefore/TruncateAfter/Close can replace or
+	// close the log's own handle without disturbing a read in progress
+	// (a file TruncateAfter shrinks in place is seen shrunk through it)
+	ownFile *os.File
+	// data is the buffer holding the current, reassembled logical record
 	data []byte
-	// recordHeader is the header of a record
-	h recordHeader
+	// dataPos is the physical position of the first fragment of the
+	// record currently in data
+	dataPos int64
+	// stream backs the io.Reader returned by the last call to NextReader
+	stream fragmentReader
+	// lastErr is the last corruption readRecord resynced past
+	lastErr error
 }
 
 // WAL represents a write ahead log that provides durability
@@ -38,6 +109,46 @@ type Wal struct {
 	// byte position where the record is writen
 	pos atomic.Int64
 	ch  chan *request
+
+	// legacy is true for logs opened with Open: a single growing file,
+	// kept around unchanged for existing callers. Logs opened with
+	// OpenSegmented set this to false and use dir/opts/segments/active
+	// instead of name/fp
+	legacy bool
+	dir    string
+	opts   Options
+	// checksum is the algorithm used to verify every record fragment.
+	// Set from Options.Checksum (segmented) or an OpenOption (legacy)
+	checksum Checksum
+	// backupStore is where Backup writes to and RecoverFromBackup reads
+	// from. Defaults to a LocalBackupStore next to name; change it with
+	// SetBackupStore. Only used by a legacy log
+	backupStore BackupStore
+	// segments holds every segment of the log, sorted by baseRecordID
+	segments []*segment
+	// active is the segment currently accepting writes, always the
+	// last element of segments
+	active *segment
+	// nextRecordID is the id that will be assigned to the next record
+	// written, used to answer NewReaderFromRecordID
+	nextRecordID atomic.Uint64
+
+	// readersMu guards readers and pendingDeletes. It's a plain,
+	// short-held mutex rather than the RWMutex above: a reader only
+	// ever holds it long enough to register or unregister itself, never
+	// for its whole lifetime, so a long-running reader can't starve
+	// TruncateBefore, TruncateAfter, Backup, or Close the way holding
+	// w.RLock() used to
+	readersMu sync.Mutex
+	readers   map[*Reader]struct{}
+	// truncateGen numbers the .pending-delete-<gen> files TruncateBefore
+	// leaves behind when a file it's replacing is still open under some
+	// reader's own handle
+	truncateGen atomic.Uint64
+	// pendingDeletes holds the path of every .pending-delete file whose
+	// removal failed, e.g. on a platform where a file can't be removed
+	// while any handle still has it open. Retried from unregisterReader
+	pendingDeletes []string
 }
 
 type request struct {
@@ -45,13 +156,11 @@ type request struct {
 	pos  int64
 	err  error
 	data []byte
-	wg   sync.WaitGroup
-}
-
-// recordHeader is the header of a record
-type recordHeader struct {
-	sum  uint32 // checksum of record
-	size uint32 // size of record
+	// reader and size are set instead of data for a request enqueued by
+	// WriteFrom, which streams its payload rather than buffering it
+	reader io.Reader
+	size   int64
+	wg     sync.WaitGroup
 }
 
 // any is used to avoid allocation
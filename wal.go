@@ -1,28 +1,49 @@
 package wal
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"os"
-	"unsafe"
+	"path/filepath"
+	"sort"
+	"time"
 
 	"github.com/google/uuid"
 )
 
-// Open open a new write ahead log
-func Open(name string, filePerm os.FileMode) (*Wal, error) {
+// Open open a new write ahead log. The log is a single growing file
+// backed by name; for a segmented log directory use OpenSegmented
+func Open(name string, filePerm os.FileMode, opts ...OpenOption) (*Wal, error) {
+	var cfg openConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
 	fp, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, filePerm)
 	if err != nil {
 		return nil, err
 	}
 	w := &Wal{
-		fp:   fp,
-		name: name,
-		ch:   make(chan *request, SyncConcurrency),
+		fp:      fp,
+		name:    name,
+		legacy:  true,
+		ch:      make(chan *request, SyncConcurrency),
+		readers: make(map[*Reader]struct{}),
+	}
+	checksum, err := openLegacyMeta(fp, cfg.checksum)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	w.checksum = checksum
+	backupStore, err := NewLocalBackupStore(filepath.Dir(name))
+	if err != nil {
+		fp.Close()
+		return nil, err
 	}
+	w.backupStore = backupStore
 	size, err := w.fileSize()
 	if err != nil {
 		fp.Close()
@@ -37,41 +58,330 @@ func Open(name string, filePerm os.FileMode) (*Wal, error) {
 	return w, nil
 }
 
-// Close close the write ahead log
+// SetBackupStore changes where Backup writes to and RecoverFromBackup
+// reads from, e.g. to an S3BackupStore or GCSBackupStore instead of the
+// LocalBackupStore a log uses by default
+func (w *Wal) SetBackupStore(store BackupStore) {
+	w.Lock()
+	defer w.Unlock()
+	w.backupStore = store
+}
+
+// openLegacyMeta loads the checksum algorithm recorded in fp's meta
+// header, writing a fresh one at offset 0 if fp is empty. requested is
+// the algorithm passed via WithChecksum, if any; if fp already has a
+// meta header recording a different one, that's an error rather than
+// something that silently mixes algorithms across restarts
+func openLegacyMeta(fp *os.File, requested Checksum) (Checksum, error) {
+	fi, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	fallback := requested
+	if fallback == nil {
+		fallback = CRC32IEEE{}
+	}
+	if fi.Size() == 0 {
+		if err := writeMetaHeader(fp, fallback); err != nil {
+			return nil, err
+		}
+		return fallback, nil
+	}
+	persisted, err := readMetaHeader(fp)
+	if err != nil {
+		return nil, err
+	}
+	if requested != nil && requested.Name() != persisted.Name() {
+		return nil, fmt.Errorf("wal: log was created with checksum %q, can't reopen with %q", persisted.Name(), requested.Name())
+	}
+	return persisted, nil
+}
+
+// OpenSegmented opens a write ahead log stored as dir, a directory of
+// fixed-size append-only store segments plus a companion mmap'd index
+// file per segment. Unlike Open, records can be located in O(1) via
+// NewReaderFromRecordID instead of a full scan
+func OpenSegmented(dir string, filePerm os.FileMode, opts Options) (*Wal, error) {
+	if err := os.MkdirAll(dir, filePerm|0111); err != nil {
+		return nil, err
+	}
+	requested := opts.Checksum
+	opts = opts.withDefaults()
+	checksum, err := openSegmentedMeta(dir, filePerm, requested, opts.Checksum)
+	if err != nil {
+		return nil, err
+	}
+	opts.Checksum = checksum
+	w := &Wal{
+		dir:      dir,
+		opts:     opts,
+		checksum: checksum,
+		ch:       make(chan *request, SyncConcurrency),
+		readers:  make(map[*Reader]struct{}),
+	}
+	if err := w.segmentedRecovery(); err != nil {
+		return nil, err
+	}
+	go w.syncLoop()
+	return w, nil
+}
+
+// openSegmentedMeta is openLegacyMeta for a segmented log, whose meta
+// header lives in a dedicated file in dir rather than at offset 0 of a
+// single file, since a segmented log's first segment can itself be
+// dropped by TruncateBefore
+func openSegmentedMeta(dir string, filePerm os.FileMode, requested, fallback Checksum) (Checksum, error) {
+	f, err := os.OpenFile(metaPath(dir), os.O_RDWR|os.O_CREATE, filePerm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		if err := writeMetaHeader(f, fallback); err != nil {
+			return nil, err
+		}
+		return fallback, nil
+	}
+	persisted, err := readMetaHeader(f)
+	if err != nil {
+		return nil, err
+	}
+	if requested != nil && requested.Name() != persisted.Name() {
+		return nil, fmt.Errorf("wal: log was created with checksum %q, can't reopen with %q", persisted.Name(), requested.Name())
+	}
+	return persisted, nil
+}
+
+// Close closes the write ahead log's own file handles. It doesn't wait
+// for active readers: each one reads through its own independently
+// opened handle (see NewReader), so closing here doesn't disturb a read
+// already in progress. Call WaitForReaders first for a shutdown that
+// waits for them to finish anyway
 func (w *Wal) Close() error {
 	w.Lock()
 	defer w.Unlock()
-	return w.fp.Close()
+	if w.legacy {
+		return w.fp.Close()
+	}
+	var err error
+	for _, s := range w.segments {
+		if e := s.close(); err == nil {
+			err = e
+		}
+	}
+	return err
 }
 
 // NewReader returns a new reader for the write ahead log,
 // the created reader traverses the current point snapshot
-// to read all the records in the current write ahead log
+// to read all the records in the current write ahead log. pos is a
+// byte position as returned by Write or Next
 func (w *Wal) NewReader(pos int64) (*Reader, error) {
-	w.RLock()
-	return &Reader{w: w, pos: pos, size: w.pos.Load()}, nil
+	w.Lock()
+	var r *Reader
+	if w.legacy {
+		r = &Reader{w: w, pos: pos, size: w.pos.Load()}
+	} else {
+		idx := w.segmentIndexForBytePos(pos)
+		seg := w.segments[idx]
+		r = &Reader{w: w, seg: seg, segBaseByteOffset: seg.baseByteOffset, pos: pos - seg.baseByteOffset, size: w.segmentSize(seg)}
+	}
+	w.Unlock()
+	if err := r.openCurrentFile(); err != nil {
+		return nil, err
+	}
+	w.registerReader(r)
+	return r, nil
+}
+
+// NewReaderFromRecordID returns a new reader positioned directly at the
+// record with the given id, via an O(1) lookup in the owning segment's
+// mmap'd index instead of a scan. Only valid for a segmented log opened
+// with OpenSegmented
+func (w *Wal) NewReaderFromRecordID(id uint64) (*Reader, error) {
+	if w.legacy {
+		return nil, errors.New("NewReaderFromRecordID requires a write ahead log opened with OpenSegmented")
+	}
+	w.Lock()
+	idx := w.segmentIndexForRecordID(id)
+	seg := w.segments[idx]
+	off, ok := seg.lookup(uint32(id - seg.baseRecordID))
+	size := w.segmentSize(seg)
+	w.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("record %v not found", id)
+	}
+	r := &Reader{w: w, seg: seg, segBaseByteOffset: seg.baseByteOffset, pos: int64(off), size: size}
+	if err := r.openCurrentFile(); err != nil {
+		return nil, err
+	}
+	w.registerReader(r)
+	return r, nil
+}
+
+// registerReader records r as active, so Wal.WaitForReaders knows to
+// wait for it
+func (w *Wal) registerReader(r *Reader) {
+	w.readersMu.Lock()
+	w.readers[r] = struct{}{}
+	w.readersMu.Unlock()
+}
+
+// unregisterReader drops r from the active set and opportunistically
+// retries any .pending-delete file a prior TruncateBefore couldn't
+// remove right away
+func (w *Wal) unregisterReader(r *Reader) {
+	w.readersMu.Lock()
+	delete(w.readers, r)
+	w.readersMu.Unlock()
+	w.retryPendingDeletes()
+}
+
+// WaitForReaders blocks until every Reader active when it's called has
+// been Closed, or ctx is done, whichever comes first. Useful for a
+// graceful shutdown that waits for in-flight readers instead of letting
+// Close run out from under them
+func (w *Wal) WaitForReaders(ctx context.Context) error {
+	w.readersMu.Lock()
+	waiting := make([]*Reader, 0, len(w.readers))
+	for r := range w.readers {
+		waiting = append(waiting, r)
+	}
+	w.readersMu.Unlock()
+	for {
+		w.readersMu.Lock()
+		n := 0
+		for _, r := range waiting {
+			if _, ok := w.readers[r]; ok {
+				n++
+			}
+		}
+		w.readersMu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// pendingDeleteName returns a fresh, never-reused path to rename a file
+// aside under when something might still have it open
+func (w *Wal) pendingDeleteName(path string) string {
+	return fmt.Sprintf("%s.pending-delete-%d", path, w.truncateGen.Add(1))
+}
+
+// deletePending removes path, a file renamed aside by TruncateBefore
+// that's no longer needed. Any reader whose own handle already has it
+// open keeps reading it fine regardless, Unix unlink-while-open
+// semantics; if the remove itself fails, e.g. a platform where a file
+// can't be deleted while any handle still references it, path is
+// retried from unregisterReader instead
+func (w *Wal) deletePending(path string) {
+	if err := os.Remove(path); err != nil {
+		w.readersMu.Lock()
+		w.pendingDeletes = append(w.pendingDeletes, path)
+		w.readersMu.Unlock()
+	}
+}
+
+func (w *Wal) retryPendingDeletes() {
+	w.readersMu.Lock()
+	pending := w.pendingDeletes
+	w.pendingDeletes = nil
+	w.readersMu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	var remaining []string
+	for _, path := range pending {
+		if err := os.Remove(path); err != nil {
+			remaining = append(remaining, path)
+		}
+	}
+	if len(remaining) > 0 {
+		w.readersMu.Lock()
+		w.pendingDeletes = append(w.pendingDeletes, remaining...)
+		w.readersMu.Unlock()
+	}
+}
+
+// segmentIndexForBytePos returns the index into w.segments of the
+// segment containing the given global byte position. Caller must hold
+// w.Lock()
+func (w *Wal) segmentIndexForBytePos(pos int64) int {
+	return sort.Search(len(w.segments), func(i int) bool {
+		return i == len(w.segments)-1 || w.segments[i+1].baseByteOffset > pos
+	})
+}
+
+// segmentIndexForRecordID returns the index into w.segments of the
+// segment containing the given record id. Caller must hold w.Lock()
+func (w *Wal) segmentIndexForRecordID(id uint64) int {
+	return sort.Search(len(w.segments), func(i int) bool {
+		return i == len(w.segments)-1 || w.segments[i+1].baseRecordID > id
+	})
+}
+
+// segmentSize returns the number of readable bytes in seg: the live
+// write position for the active segment, the on-disk size for sealed
+// ones. Caller must hold w.Lock()
+func (w *Wal) segmentSize(seg *segment) int64 {
+	if seg == w.active {
+		return w.pos.Load() - w.active.baseByteOffset
+	}
+	return seg.storeSize
 }
 
 // TruncateBefore truncates the front of the write ahead log by
-// removing all records that are before the provided pos
-// this operation is mutually exclusive with all read and write operations
+// removing all records that are before the provided pos. It's mutually
+// exclusive with Write and with every other TruncateBefore/
+// TruncateAfter/Backup/RecoverFromBackup/Close, but not with an active
+// Reader: readers keep working against their own independently opened
+// handles (see NewReader) while this renames the file(s) they came from
+// out from under that name
 func (w *Wal) TruncateBefore(pos int64) error {
-	var err error
-
 	w.Lock()
 	defer w.Unlock()
+	if w.legacy {
+		return w.legacyTruncateBefore(pos)
+	}
+	return w.segmentedTruncateBefore(pos)
+}
+
+// legacyTruncateBefore renames the log's current file aside to a
+// .pending-delete-<gen> name rather than removing it outright, then
+// moves the rewritten, renumbered-from-0 tail into place under the
+// original name. Any Reader already iterating the old file through its
+// own independently opened handle (see NewReader) keeps reading it
+// fine, Unix unlink-while-open semantics; the pending file itself is
+// cleaned up by deletePending once nothing still has it open
+func (w *Wal) legacyTruncateBefore(pos int64) error {
+	var err error
+
 	if err := w.backup("back", 0); err != nil {
 		return err
 	}
 	defer w.removeBackup("back")
-	if err := w.backup("temp", pos); err != nil {
+	if err := w.backupTail("temp", pos); err != nil {
 		return err
 	}
-	if err := os.Remove(w.name); err != nil {
+	pending := w.pendingDeleteName(w.name)
+	if err := os.Rename(w.name, pending); err != nil {
 		return err
 	}
 	w.fp.Close()
 	if err := os.Rename(w.name+".temp", w.name); err != nil {
+		if err := os.Rename(pending, w.name); err != nil {
+			panic(err)
+		}
 		w.removeBackup("temp")
 		if err := w.recoverFromBackup("back"); err != nil {
 			panic(err)
@@ -87,15 +397,51 @@ func (w *Wal) TruncateBefore(pos int64) error {
 		return err
 	}
 	w.pos.Store(size)
+	w.deletePending(pending)
+	return nil
+}
+
+// segmentedTruncateBefore drops every sealed segment that ends at or
+// before pos, renaming its store file aside rather than removing it
+// outright (see deletePending); the segment that actually contains pos
+// falls back to today's copy path, shrinking its store file down to
+// just the records at or after pos. Like the legacy log, positions are
+// renumbered from 0 at the new front of the log
+func (w *Wal) segmentedTruncateBefore(pos int64) error {
+	idx := w.segmentIndexForBytePos(pos)
+	for _, s := range w.segments[:idx] {
+		if err := s.remove(w.pendingDeleteName, w.deletePending); err != nil {
+			return err
+		}
+	}
+	boundary := w.segments[idx]
+	local := pos - boundary.baseByteOffset
+	w.segments = append([]*segment{}, w.segments[idx:]...)
+	if local > 0 {
+		if err := boundary.truncateBefore(local, w.pendingDeleteName, w.deletePending); err != nil {
+			return err
+		}
+		// the boundary segment's store file now starts at pos
+		boundary.baseByteOffset += local
+	}
+	for _, s := range w.segments {
+		s.baseByteOffset -= pos
+	}
+	w.pos.Add(-pos)
 	return nil
 }
 
 // TruncateAfter truncates the back of the write ahead log by
-// removing all records after the provided pos
-// this operation is mutually exclusive with all read and write operations
+// removing all records after the provided pos. Like TruncateBefore it
+// doesn't wait for an active Reader, but the file containing pos is
+// shrunk in place rather than renamed aside, so a Reader with its own
+// handle onto that file no longer finds the records removed from it
 func (w *Wal) TruncateAfter(pos int64) error {
 	w.Lock()
 	defer w.Unlock()
+	if !w.legacy {
+		return w.segmentedTruncateAfter(pos)
+	}
 	if err := w.backup("back", 0); err != nil {
 		return err
 	}
@@ -113,6 +459,26 @@ func (w *Wal) TruncateAfter(pos int64) error {
 	return nil
 }
 
+// segmentedTruncateAfter drops every segment that starts at or after pos
+// and shrinks the segment containing pos down to it
+func (w *Wal) segmentedTruncateAfter(pos int64) error {
+	idx := w.segmentIndexForBytePos(pos)
+	for _, s := range w.segments[idx+1:] {
+		if err := s.remove(w.pendingDeleteName, w.deletePending); err != nil {
+			return err
+		}
+	}
+	w.segments = w.segments[:idx+1]
+	w.active = w.segments[idx]
+	w.active.next = nil
+	local := pos - w.active.baseByteOffset
+	if err := w.active.truncateAfter(local); err != nil {
+		return err
+	}
+	w.pos.Store(pos)
+	return w.writeSyncRecord()
+}
+
 // write a record to the write ahead log,
 // return the position of the record
 func (w *Wal) Write(p []byte) (int64, error) {
@@ -126,6 +492,7 @@ func (w *Wal) Write(p []byte) (int64, error) {
 	defer reqPool.Put(req)
 	req.err = nil
 	req.data = p
+	req.reader = nil
 	req.wg.Add(1)
 	w.RLock()
 	defer w.RUnlock()
@@ -134,31 +501,116 @@ func (w *Wal) Write(p []byte) (int64, error) {
 	return req.pos, req.err
 }
 
-// Backup backup the write ahead log, return the backup file name
-// this operation is mutually exclusive with all read and write operations
+// WriteFrom writes a record of size bytes read from r to the write
+// ahead log, without requiring the whole record be buffered in memory
+// first, and returns the position of the record
+func (w *Wal) WriteFrom(r io.Reader, size int64) (int64, error) {
+	if size == 0 {
+		return -1, nil
+	}
+	if size > MaxRecordSize {
+		return -1, fmt.Errorf("Illegal record size: max size is %v", MaxRecordSize)
+	}
+	req := reqPool.Get().(*request)
+	defer reqPool.Put(req)
+	req.err = nil
+	req.data = nil
+	req.reader = r
+	req.size = size
+	req.wg.Add(1)
+	w.RLock()
+	defer w.RUnlock()
+	w.ch <- req
+	req.wg.Wait()
+	return req.pos, req.err
+}
+
+// Backup streams the write ahead log through its BackupStore under a
+// fresh UUID key and returns that key. See TruncateBefore for how this
+// interacts with an active Reader
 func (w *Wal) Backup() (string, error) {
 	w.Lock()
 	defer w.Unlock()
+	if !w.legacy {
+		return "", errors.New("Backup is not yet supported for a segmented write ahead log")
+	}
+	size, err := w.fileSize()
+	if err != nil {
+		return "", err
+	}
+	src, err := os.Open(w.name)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
 	id := uuid.New()
-	name := hex.EncodeToString(id[:])
-	if err := w.backup(name, 0); err != nil {
+	key := hex.EncodeToString(id[:])
+	if err := w.backupStore.Put(key, src, size); err != nil {
 		return "", err
 	}
-	return name, nil
+	return key, nil
 }
 
-// RecoverFromBackup recover the write ahead log from the backup
-// this operation is mutually exclusive with all read and write operations
-func (w *Wal) RecoverFromBackup(name string) error {
-	if err := os.Remove(w.name); err != nil {
+// RecoverFromBackup recovers the write ahead log from the object stored
+// under key in its BackupStore: it's streamed into a temp file, fsync'd,
+// then atomically renamed into place over the log's current file. See
+// TruncateBefore for how this interacts with an active Reader
+func (w *Wal) RecoverFromBackup(key string) error {
+	w.Lock()
+	defer w.Unlock()
+	if !w.legacy {
+		return errors.New("RecoverFromBackup is not yet supported for a segmented write ahead log")
+	}
+	rc, _, err := w.backupStore.Get(key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	tmpName := w.name + ".recover"
+	tmp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0664)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, rc); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := w.fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, w.name); err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(w.name, os.O_RDWR|os.O_CREATE, 0664)
+	if err != nil {
+		return err
+	}
+	w.fp = fp
+	size, err := w.fileSize()
+	if err != nil {
 		return err
 	}
-	return w.recoverFromBackup(name)
+	w.pos.Store(size)
+	return nil
 }
 
-// Close close the reader
+// Close closes the reader's own file handle and drops it from its
+// Wal's active set
 func (r *Reader) Close() {
-	r.w.RUnlock()
+	if r.ownFile != nil {
+		r.ownFile.Close()
+	}
+	r.w.unregisterReader(r)
 }
 
 // Next read a record from the write ahead log,
@@ -166,19 +618,77 @@ func (r *Reader) Close() {
 // the position for the write ahead log, -1 means the last record
 func (r *Reader) Next() (int64, []byte, error) {
 	for {
-		if r.pos == r.size {
-			return -1, nil, nil
-		}
 		if err := r.readRecord(); err != nil {
+			if err == io.EOF {
+				if r.seg != nil && r.advanceSegment() {
+					continue
+				}
+				return -1, nil, nil
+			}
 			return -1, nil, err
 		}
 		if len(r.data) == 0 {
 			continue
 		}
-		return r.pos - int64(len(r.data)+RecordHeaderSize), r.data, nil
+		pos := r.dataPos
+		if r.seg != nil {
+			pos += r.segBaseByteOffset
+		}
+		return pos, r.data, nil
 	}
 }
 
+// advanceSegment moves the reader on to the next segment once it has
+// exhausted the current one, opening its own handle onto the new
+// segment's store file; returns false once there is nothing left, or
+// if opening that handle fails, in which case the error is recorded as
+// the reader's LastError. It walks seg.next rather than indexing into
+// w.segments, so it keeps working even if this reader's current
+// segment has since been dropped from the front of w.segments by a
+// concurrent TruncateBefore
+func (r *Reader) advanceSegment() bool {
+	r.w.Lock()
+	next := r.seg.next
+	if next == nil {
+		r.w.Unlock()
+		return false
+	}
+	r.seg = next
+	r.segBaseByteOffset = next.baseByteOffset
+	size := r.w.segmentSize(next)
+	r.w.Unlock()
+	r.pos = 0
+	r.size = size
+	if err := r.openCurrentFile(); err != nil {
+		r.lastErr = err
+		return false
+	}
+	return true
+}
+
+// openCurrentFile (re)opens this reader's own handle onto whichever
+// file it's currently positioned in: the current segment's store file
+// in segmented mode, the log's single file otherwise. Reading through
+// a handle opened independently of w.fp/seg.store means a concurrent
+// TruncateBefore, TruncateAfter, or Close can rename, replace, or close
+// the log's own handle without disturbing a read already in progress;
+// a file that TruncateAfter shrinks in place is seen shrunk here too
+func (r *Reader) openCurrentFile() error {
+	path := r.w.name
+	if r.seg != nil {
+		path = r.seg.storePath
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if r.ownFile != nil {
+		r.ownFile.Close()
+	}
+	r.ownFile = f
+	return nil
+}
+
 func (w *Wal) syncLoop() {
 	reqs := make([]*request, 0, SyncConcurrency)
 	for {
@@ -189,7 +699,11 @@ func (w *Wal) syncLoop() {
 				break
 			}
 			for _, req := range reqs {
-				req.pos, req.err = w.writeRecord(req.data)
+				if req.reader != nil {
+					req.pos, req.err = w.writeStreamedRecord(req.reader, req.size)
+				} else {
+					req.pos, req.err = w.writeRecord(req.data)
+				}
 			}
 			err := w.writeSyncRecord()
 			for _, req := range reqs {
@@ -204,24 +718,18 @@ func (w *Wal) syncLoop() {
 }
 
 func (w *Wal) recovery() error {
-	var pos int64
+	pos := int64(MetaHeaderSize)
 
 	r, err := w.NewReader(0)
 	if err != nil {
 		return nil
 	}
 	defer r.Close()
-	if r.size == 0 {
+	if r.size <= MetaHeaderSize {
 		return nil
 	}
-	for {
-		if r.size < r.pos+RecordHeaderSize { // incompleted data
-			break
-		}
-		if err := r.readRecord(); err != nil {
-			break
-		}
-		if r.h.size == 0 { // sync record
+	for r.readRecord() == nil {
+		if len(r.data) == 0 { // sync record
 			pos = r.pos
 		}
 	}
@@ -229,6 +737,58 @@ func (w *Wal) recovery() error {
 	return w.fp.Truncate(pos)
 }
 
+// segmentedRecovery loads every segment found in w.dir, in order, and
+// replays only the tail of the active (last) one to find the last sync
+// record: sealed segments were already synced and sealed when they were
+// rolled, so only the active segment can have a torn tail
+func (w *Wal) segmentedRecovery() error {
+	ids, err := listSegmentBaseIDs(w.dir)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		s, err := createSegment(w.dir, 0, w.opts)
+		if err != nil {
+			return err
+		}
+		w.segments = []*segment{s}
+		w.active = s
+		return nil
+	}
+	var baseByte int64
+	for _, id := range ids {
+		s, err := openSegment(w.dir, id)
+		if err != nil {
+			return err
+		}
+		s.baseByteOffset = baseByte
+		baseByte += s.storeSize
+		if len(w.segments) > 0 {
+			w.segments[len(w.segments)-1].next = s
+		}
+		w.segments = append(w.segments, s)
+	}
+	w.active = w.segments[len(w.segments)-1]
+
+	r := &Reader{w: w, seg: w.active, size: w.active.storeSize}
+	if err := r.openCurrentFile(); err != nil {
+		return err
+	}
+	defer r.ownFile.Close()
+	var pos int64
+	for r.readRecord() == nil {
+		if len(r.data) == 0 { // sync record
+			pos = r.pos
+		}
+	}
+	if err := w.active.truncateAfter(pos); err != nil {
+		return err
+	}
+	w.pos.Store(w.active.baseByteOffset + pos)
+	w.nextRecordID.Store(w.active.baseRecordID + uint64(w.active.indexLen))
+	return nil
+}
+
 func (w *Wal) backup(suffix string, pos int64) error {
 	size, err := w.fileSize()
 	if err != nil {
@@ -258,10 +818,51 @@ func (w *Wal) backup(suffix string, pos int64) error {
 	return nil
 }
 
+// backupTail is backup, but the copy begins with a fresh meta header
+// instead of name's existing one: the records copied from pos onward
+// no longer start where the original log's did, so legacyTruncateBefore
+// uses this instead of backup to rebuild a log renumbered from 0
+func (w *Wal) backupTail(suffix string, pos int64) error {
+	name := w.name + "." + suffix
+	src, err := os.OpenFile(w.name, os.O_RDWR, 0664)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if off, err := src.Seek(pos, 0); err != nil {
+		return err
+	} else if off != pos {
+		return errors.New("Backup failed")
+	}
+	dst, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0664)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if err := writeMetaHeader(dst, w.checksum); err != nil {
+		return err
+	}
+	// writeMetaHeader uses WriteAt, which doesn't move dst's sequential
+	// write offset; seek past the header before io.Copy appends the
+	// copied records, or they'd overwrite it at offset 0
+	if _, err := dst.Seek(MetaHeaderSize, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (w *Wal) removeBackup(suffix string) error {
 	return os.Remove(w.name + "." + suffix)
 }
 
+// recoverFromBackup rolls back to the local-filesystem safety copy
+// backup/backupTail made under suffix. It's unrelated to the public
+// RecoverFromBackup/BackupStore API: TruncateBefore/TruncateAfter use
+// it to undo their own in-place rewrite if it fails partway through, so
+// it always stays on the local filesystem regardless of BackupStore
 func (w *Wal) recoverFromBackup(suffix string) error {
 	w.fp.Close()
 	if err := os.Rename(w.name+"."+suffix, w.name); err != nil {
@@ -289,73 +890,121 @@ func (w *Wal) fileSize() (int64, error) {
 }
 
 func (w *Wal) writeRecord(p []byte) (int64, error) {
-	var h recordHeader
-
-	n := len(p)
+	if !w.legacy {
+		return w.writeSegmentedRecord(p)
+	}
 	pos := w.pos.Load()
-	h.size = uint32(n)
-	h.sum = crc32.ChecksumIEEE(p)
+	n, err := w.writeChunked(w.fp, pos, p)
+	if err != nil {
+		return -1, err
+	}
+	w.pos.Add(n)
+	return pos, nil
+}
 
-	if n, err := w.fp.WriteAt(encode(&h), pos); err != nil {
+// writeSegmentedRecord writes p to the active segment, rolling to a
+// fresh segment first if p would overflow it
+func (w *Wal) writeSegmentedRecord(p []byte) (int64, error) {
+	if err := w.rollIfNeeded(int64(w.headerSize() + len(p))); err != nil {
 		return -1, err
-	} else if n != RecordHeaderSize {
-		return -1, errors.New("Fail to write record")
 	}
-	if n, err := w.fp.WriteAt(p, pos+RecordHeaderSize); err != nil {
+	pos := w.pos.Load()
+	local := pos - w.active.baseByteOffset
+	n, err := w.writeChunked(w.active.store, local, p)
+	if err != nil {
 		return -1, err
-	} else if n != len(p) {
-		return -1, errors.New("Fail to write record")
 	}
-	w.pos.Add(int64(n + RecordHeaderSize))
+	recordID := w.nextRecordID.Add(1) - 1
+	w.active.appendIndex(uint32(recordID-w.active.baseRecordID), uint32(local))
+	w.active.storeSize = local + n
+	w.pos.Add(n)
 	return pos, nil
 }
 
-func (w *Wal) writeSyncRecord() error {
-	var h recordHeader
-
-	if n, err := w.fp.WriteAt(encode(&h), w.pos.Load()); err != nil {
-		return err
-	} else if n != RecordHeaderSize {
-		return errors.New("Fail to write sync record")
+// writeStreamedRecord is writeRecord, but streams its payload from r
+// instead of requiring it already be in memory, for a request enqueued
+// by WriteFrom
+func (w *Wal) writeStreamedRecord(r io.Reader, size int64) (int64, error) {
+	if !w.legacy {
+		return w.writeSegmentedStreamedRecord(r, size)
 	}
-	w.pos.Add(RecordHeaderSize)
-	return w.fp.Sync()
-}
-
-func encode[T any](v *T) []byte {
-	return unsafe.Slice((*byte)(unsafe.Pointer(v)), unsafe.Sizeof(*v))
+	pos := w.pos.Load()
+	n, err := w.writeChunkedFrom(w.fp, pos, r, size)
+	if err != nil {
+		return -1, err
+	}
+	w.pos.Add(n)
+	return pos, nil
 }
 
-func decode[T any](v []byte) T {
-	return *(*T)(unsafe.Pointer(&v[0]))
+// writeSegmentedStreamedRecord is writeSegmentedRecord, but streams its
+// payload from r instead of requiring it already be in memory
+func (w *Wal) writeSegmentedStreamedRecord(r io.Reader, size int64) (int64, error) {
+	if err := w.rollIfNeeded(int64(w.headerSize()) + size); err != nil {
+		return -1, err
+	}
+	pos := w.pos.Load()
+	local := pos - w.active.baseByteOffset
+	n, err := w.writeChunkedFrom(w.active.store, local, r, size)
+	if err != nil {
+		return -1, err
+	}
+	recordID := w.nextRecordID.Add(1) - 1
+	w.active.appendIndex(uint32(recordID-w.active.baseRecordID), uint32(local))
+	w.active.storeSize = local + n
+	w.pos.Add(n)
+	return pos, nil
 }
 
-func (r *Reader) readRecord() error {
-	if err := r.readRecordHeader(); err != nil {
-		return err
-	}
-	if cap(r.data) < int(r.h.size) {
-		r.data = make([]byte, r.h.size)
+// rollIfNeeded seals the active segment and opens a fresh one once
+// writing size more bytes to it would exceed Options.SegmentSize
+func (w *Wal) rollIfNeeded(size int64) error {
+	if w.active.storeSize == 0 || w.active.storeSize+size <= w.opts.SegmentSize {
+		return nil
 	}
-	r.data = r.data[:r.h.size]
-	if n, err := r.w.fp.ReadAt(r.data, r.pos); err != nil {
+	if err := w.active.store.Sync(); err != nil {
 		return err
-	} else if n != len(r.data) {
-		return errors.New("Fail to read record")
 	}
-	if crc32.ChecksumIEEE(r.data) != r.h.sum {
-		return errors.New("Fail to read record: checksum is wrong, data is broken")
+	s, err := createSegment(w.dir, w.nextRecordID.Load(), w.opts)
+	if err != nil {
+		return err
 	}
-	r.pos += int64(r.h.size)
+	s.baseByteOffset = w.pos.Load()
+	w.segments = append(w.segments, s)
+	w.active.next = s
+	w.active = s
 	return nil
 }
 
-func (r *Reader) readRecordHeader() error {
-	if n, err := r.w.fp.ReadAt(encode(&r.h), r.pos); err != nil {
+func (w *Wal) writeSyncRecord() error {
+	if !w.legacy {
+		return w.writeSegmentedSyncRecord()
+	}
+	pos := w.pos.Load()
+	n, err := w.writeChunked(w.fp, pos, nil)
+	if err != nil {
 		return err
-	} else if n != RecordHeaderSize {
-		return errors.New("Fail to read record")
 	}
-	r.pos += RecordHeaderSize
-	return nil
+	w.pos.Add(n)
+	return w.fp.Sync()
+}
+
+// writeSegmentedSyncRecord is the segmented equivalent of writeSyncRecord:
+// a zero-length FULL record, written to and flushing the active segment
+func (w *Wal) writeSegmentedSyncRecord() error {
+	local := w.pos.Load() - w.active.baseByteOffset
+	n, err := w.writeChunked(w.active.store, local, nil)
+	if err != nil {
+		return err
+	}
+	w.active.storeSize = local + n
+	w.pos.Add(n)
+	return w.active.store.Sync()
+}
+
+// file returns the handle the reader is currently reading from: its
+// own, independently opened copy of the segment's store file in
+// segmented mode, or of the log's single file otherwise
+func (r *Reader) file() *os.File {
+	return r.ownFile
 }
@@ -1,9 +1,14 @@
 package wal
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -132,6 +137,429 @@ func TestBackup(t *testing.T) {
 	os.Remove("test.log")
 }
 
+// TestRecoveryKeepsTailAfterCorruption reproduces a bit-flip in the
+// payload of the earliest record of a log much smaller than BlockSize.
+// A single corrupt record must only cost that one record, not every
+// synced record written after it
+func TestRecoveryKeepsTailAfterCorruption(t *testing.T) {
+	w, err := Open("test.log", 0664)
+	require.NoError(t, err)
+	testRecords := make([]testRecord, testRecordNum)
+	for i := 0; i < testRecordNum; i++ {
+		testRecords[i].data = []byte(fmt.Sprintf("record%v", i))
+		pos, err := w.Write(testRecords[i].data)
+		require.NoError(t, err)
+		testRecords[i].pos = pos
+	}
+	require.NoError(t, w.Close())
+
+	fp, err := os.OpenFile("test.log", os.O_RDWR, 0664)
+	require.NoError(t, err)
+	payloadPos := testRecords[0].pos + int64(w.headerSize())
+	b := make([]byte, 1)
+	_, err = fp.ReadAt(b, payloadPos)
+	require.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = fp.WriteAt(b, payloadPos)
+	require.NoError(t, err)
+	require.NoError(t, fp.Close())
+
+	w, err = Open("test.log", 0664)
+	require.NoError(t, err)
+	r, err := w.NewReader(0)
+	require.NoError(t, err)
+	var got []testRecord
+	for {
+		pos, data, err := r.Next()
+		require.NoError(t, err)
+		if pos == -1 {
+			break
+		}
+		got = append(got, testRecord{pos: pos, data: append([]byte{}, data...)})
+	}
+	require.NotNil(t, r.LastError())
+	r.Close()
+	require.Equal(t, testRecordNum-1, len(got))
+	for i, rec := range got {
+		require.Equal(t, testRecords[i+1].data, rec.data)
+	}
+	require.NoError(t, w.Close())
+	os.Remove("test.log")
+}
+
+// TestSegmentedTruncateBeforeSurvivesRestart reproduces a crash found by
+// chaining a straightforward sequence of public calls: TruncateBefore
+// on a segmented log, then a process restart. truncateBefore used to
+// only bump baseRecordID in memory, leaving the segment's on-disk
+// filenames (which encode baseRecordID) stale, so reopening recomputed
+// the wrong baseRecordID from the filename and NewReaderFromRecordID's
+// index lookup ran off into unmapped memory
+func TestSegmentedTruncateBeforeSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenSegmented(dir, 0664, Options{})
+	require.NoError(t, err)
+	const n = 20
+	positions := make([]int64, n)
+	for i := 0; i < n; i++ {
+		pos, err := w.Write([]byte(fmt.Sprintf("record%v", i)))
+		require.NoError(t, err)
+		positions[i] = pos
+	}
+	require.NoError(t, w.TruncateBefore(positions[10]))
+	require.NoError(t, w.Close())
+
+	w, err = OpenSegmented(dir, 0664, Options{})
+	require.NoError(t, err)
+	r, err := w.NewReaderFromRecordID(10)
+	require.NoError(t, err)
+	pos, data, err := r.Next()
+	require.NoError(t, err)
+	require.NotEqual(t, int64(-1), pos)
+	require.Equal(t, []byte("record10"), data)
+	r.Close()
+	require.NoError(t, w.Close())
+}
+
+// TestSegmentedTruncateAfterClearsDanglingNext reproduces a Reader that
+// reaches the end of the new active segment after a TruncateAfter drops
+// every segment beyond it: the dropped segment's object stayed linked
+// as the new active segment's next, which pointed at a store file
+// TruncateAfter had already removed, so advanceSegment would try to
+// open it instead of correctly reporting no more data, leaving a
+// spurious LastError behind on what should be a clean EOF
+func TestSegmentedTruncateAfterClearsDanglingNext(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenSegmented(dir, 0664, Options{SegmentSize: 64})
+	require.NoError(t, err)
+	const n = 30
+	positions := make([]int64, n)
+	for i := 0; i < n; i++ {
+		pos, err := w.Write([]byte(fmt.Sprintf("record%02d", i)))
+		require.NoError(t, err)
+		positions[i] = pos
+	}
+	require.Greater(t, len(w.segments), 3)
+
+	require.NoError(t, w.TruncateAfter(positions[20]))
+
+	r, err := w.NewReader(0)
+	require.NoError(t, err)
+	i := 0
+	for ; ; i++ {
+		pos, data, err := r.Next()
+		require.NoError(t, err)
+		if pos == -1 {
+			break
+		}
+		require.Equal(t, []byte(fmt.Sprintf("record%02d", i)), data)
+	}
+	require.NoError(t, r.LastError())
+	r.Close()
+	require.Equal(t, 20, i)
+	require.NoError(t, w.Close())
+}
+
+// TestSegmentedTruncateBeforeDoesNotDisruptActiveReader reproduces a
+// Reader that was already iterating across several segments silently
+// jumping to the wrong one once a concurrent TruncateBefore drops the
+// segments in front of it: advanceSegment used to index into
+// w.segments by a position captured before the drop, which pointed
+// somewhere else entirely once the slice was reslice from under it.
+// Run with -race: before the fix this also caught an unsynchronized
+// read (Reader.Next) racing the write (TruncateBefore) of the same
+// segment's baseByteOffset
+func TestSegmentedTruncateBeforeDoesNotDisruptActiveReader(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenSegmented(dir, 0664, Options{SegmentSize: 64})
+	require.NoError(t, err)
+	const n = 30
+	testRecords := make([]testRecord, n)
+	for i := 0; i < n; i++ {
+		testRecords[i].data = []byte(fmt.Sprintf("record%02d", i))
+		pos, err := w.Write(testRecords[i].data)
+		require.NoError(t, err)
+		testRecords[i].pos = pos
+	}
+	// SegmentSize is small enough relative to each record's physical
+	// footprint that this spans several segments
+	require.Greater(t, len(w.segments), 3)
+
+	r, err := w.NewReader(0)
+	require.NoError(t, err)
+
+	var readCount atomic.Int64
+	got := make(chan []testRecord, 1)
+	go func() {
+		var records []testRecord
+		for {
+			pos, data, err := r.Next()
+			require.NoError(t, err)
+			if pos == -1 {
+				break
+			}
+			records = append(records, testRecord{pos: pos, data: append([]byte{}, data...)})
+			readCount.Add(1)
+		}
+		got <- records
+	}()
+
+	// let the reader advance well past the records about to be dropped
+	// before truncating, matching how TruncateBefore is meant to be
+	// used: to drop a prefix readers have already moved past, not one
+	// they haven't reached yet
+	for readCount.Load() < 22 {
+		time.Sleep(time.Millisecond)
+	}
+	require.NoError(t, w.TruncateBefore(testRecords[20].pos))
+
+	var records []testRecord
+	select {
+	case records = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader never finished")
+	}
+	r.Close()
+
+	require.Equal(t, n, len(records))
+	for i, rec := range records {
+		require.Equal(t, testRecords[i].data, rec.data, "record %v", i)
+	}
+	require.NoError(t, w.Close())
+}
+
+// TestWriteFromAndNextReader exercises the streaming write/read path:
+// WriteFrom takes its payload from an io.Reader instead of a byte
+// slice, and NextReader hands the payload back the same way instead of
+// buffering the whole record up front
+func TestWriteFromAndNextReader(t *testing.T) {
+	testRecords := make([]testRecord, testRecordNum)
+	for i := 0; i < testRecordNum; i++ {
+		testRecords[i].data = []byte(fmt.Sprintf("streamed-record-%v", i))
+	}
+	w, err := Open("test.log", 0664)
+	require.NoError(t, err)
+	for i := range testRecords {
+		pos, err := w.WriteFrom(bytes.NewReader(testRecords[i].data), int64(len(testRecords[i].data)))
+		require.NoError(t, err)
+		testRecords[i].pos = pos
+	}
+	r, err := w.NewReader(0)
+	require.NoError(t, err)
+	for i := 0; i < len(testRecords); {
+		pos, rr, err := r.NextReader()
+		require.NoError(t, err)
+		require.NotEqual(t, int64(-1), pos, "ran out of records before finding every write")
+		data, err := io.ReadAll(rr)
+		require.NoError(t, err)
+		if len(data) == 0 { // sync record
+			continue
+		}
+		require.Equal(t, testRecords[i].pos, pos)
+		require.Equal(t, testRecords[i].data, data)
+		i++
+	}
+	r.Close()
+	require.NoError(t, w.Close())
+	os.Remove("test.log")
+}
+
+// TestWithChecksum exercises every registered Checksum end to end, and
+// verifies that reopening an existing log with a different one fails
+// instead of silently mixing algorithms
+func TestWithChecksum(t *testing.T) {
+	for _, c := range []Checksum{CRC32IEEE{}, CRC32C{}, XXHash64{}} {
+		t.Run(c.Name(), func(t *testing.T) {
+			testRecords := make([]testRecord, testRecordNum)
+			for i := 0; i < testRecordNum; i++ {
+				testRecords[i].data = []byte(fmt.Sprintf("record%v", i))
+			}
+			w, err := Open("test.log", 0664, WithChecksum(c))
+			require.NoError(t, err)
+			for i := range testRecords {
+				pos, err := w.Write(testRecords[i].data)
+				require.NoError(t, err)
+				testRecords[i].pos = pos
+			}
+			require.NoError(t, w.Close())
+
+			// reopening with no explicit checksum recovers the one the
+			// log was created with
+			w, err = Open("test.log", 0664)
+			require.NoError(t, err)
+			r, err := w.NewReader(0)
+			require.NoError(t, err)
+			for i := 0; ; i++ {
+				pos, data, err := r.Next()
+				require.NoError(t, err)
+				if pos == -1 {
+					break
+				}
+				require.Equal(t, testRecords[i].pos, pos)
+				require.Equal(t, testRecords[i].data, data)
+			}
+			r.Close()
+			require.NoError(t, w.Close())
+
+			var other Checksum = CRC32IEEE{}
+			if c.Name() == other.Name() {
+				other = CRC32C{}
+			}
+			_, err = Open("test.log", 0664, WithChecksum(other))
+			require.Error(t, err)
+
+			os.Remove("test.log")
+		})
+	}
+}
+
+// memBackupStore is a minimal, in-memory BackupStore used to verify
+// that Backup/RecoverFromBackup go through whatever store is installed
+// with SetBackupStore instead of always using the LocalBackupStore
+type memBackupStore struct {
+	objects map[string][]byte
+}
+
+func newMemBackupStore() *memBackupStore {
+	return &memBackupStore{objects: make(map[string][]byte)}
+}
+
+func (s *memBackupStore) Put(name string, r io.Reader, size int64) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.objects[name] = b
+	return nil
+}
+
+func (s *memBackupStore) Get(name string) (io.ReadCloser, int64, error) {
+	b, ok := s.objects[name]
+	if !ok {
+		return nil, 0, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(b)), int64(len(b)), nil
+}
+
+func (s *memBackupStore) List() ([]string, error) {
+	names := make([]string, 0, len(s.objects))
+	for name := range s.objects {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (s *memBackupStore) Delete(name string) error {
+	delete(s.objects, name)
+	return nil
+}
+
+func TestSetBackupStore(t *testing.T) {
+	testRecords := make([]testRecord, testRecordNum)
+	for i := 0; i < testRecordNum; i++ {
+		testRecords[i].data = []byte(fmt.Sprintf("record%v", i))
+	}
+	w, err := Open("test.log", 0664)
+	require.NoError(t, err)
+	store := newMemBackupStore()
+	w.SetBackupStore(store)
+	for i := range testRecords {
+		pos, err := w.Write(testRecords[i].data)
+		require.NoError(t, err)
+		testRecords[i].pos = pos
+	}
+	key, err := w.Backup()
+	require.NoError(t, err)
+	require.Len(t, store.objects, 1)
+
+	require.NoError(t, w.RecoverFromBackup(key))
+	r, err := w.NewReader(0)
+	require.NoError(t, err)
+	for i := 0; ; i++ {
+		pos, data, err := r.Next()
+		require.NoError(t, err)
+		if pos == -1 {
+			break
+		}
+		require.Equal(t, testRecords[i].pos, pos)
+		require.Equal(t, testRecords[i].data, data)
+	}
+	r.Close()
+	require.NoError(t, w.Close())
+	os.Remove("test.log")
+}
+
+// TestTruncateBeforeDoesNotBlockOnActiveReader verifies a reader opened
+// before a TruncateBefore doesn't need to be closed first: it keeps
+// reading the data it started with through its own independently
+// opened file handle, and TruncateBefore itself doesn't have to wait
+// for it the way holding w.RLock() for a reader's whole lifetime used to
+func TestTruncateBeforeDoesNotBlockOnActiveReader(t *testing.T) {
+	testRecords := make([]testRecord, testRecordNum)
+	for i := 0; i < testRecordNum; i++ {
+		testRecords[i].data = []byte(fmt.Sprintf("record%v", i))
+	}
+	w, err := Open("test.log", 0664)
+	require.NoError(t, err)
+	for i := range testRecords {
+		pos, err := w.Write(testRecords[i].data)
+		require.NoError(t, err)
+		testRecords[i].pos = pos
+	}
+
+	r, err := w.NewReader(0)
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() { done <- w.TruncateBefore(testRecords[5].pos) }()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("TruncateBefore blocked on an active reader")
+	}
+
+	for i := 0; ; i++ {
+		pos, data, err := r.Next()
+		require.NoError(t, err)
+		if pos == -1 {
+			require.Equal(t, testRecordNum, i)
+			break
+		}
+		require.Equal(t, testRecords[i].pos, pos)
+		require.Equal(t, testRecords[i].data, data)
+	}
+	r.Close()
+	require.NoError(t, w.Close())
+	os.Remove("test.log")
+}
+
+// TestWaitForReaders checks that WaitForReaders blocks until every
+// reader active when it was called has been Closed
+func TestWaitForReaders(t *testing.T) {
+	w, err := Open("test.log", 0664)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("record"))
+	require.NoError(t, err)
+
+	r, err := w.NewReader(0)
+	require.NoError(t, err)
+
+	var closed atomic.Bool
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		closed.Store(true)
+		r.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, w.WaitForReaders(ctx))
+	require.True(t, closed.Load())
+
+	require.NoError(t, w.Close())
+	os.Remove("test.log")
+}
+
 func BenchmarkWrite(b *testing.B) {
 	w, err := Open("test.log", 0664)
 	require.NoError(b, err)